@@ -0,0 +1,225 @@
+package messenger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// GraphURL is the Graph API root used for batch requests.
+const GraphURL = "https://graph.facebook.com/"
+
+// BatchOp describes a single sub-request within a Graph API batch call. See
+// https://developers.facebook.com/docs/graph-api/batch-requests for the
+// field semantics.
+type BatchOp struct {
+	// Method is the HTTP method of the sub-request, e.g. "GET" or "POST".
+	Method string
+	// RelativeURL is the sub-request's path and query string, relative to
+	// GraphURL, e.g. "me/messages" or "<id>?fields=name".
+	RelativeURL string
+	// Body is the sub-request's JSON body. Empty for GET requests.
+	Body string
+	// Name optionally labels this op so a later op can DependsOn it.
+	Name string
+	// DependsOn optionally names an earlier op in the same batch that must
+	// complete first.
+	DependsOn string
+	// OmitResponseOnSuccess drops the sub-response body when the call
+	// succeeds, saving bandwidth for fire-and-forget ops.
+	OmitResponseOnSuccess bool
+}
+
+// MarshalJSON renders a BatchOp using the field names the Graph API batch
+// endpoint expects.
+func (op BatchOp) MarshalJSON() ([]byte, error) {
+	type wire struct {
+		Method                string `json:"method"`
+		RelativeURL           string `json:"relative_url"`
+		Body                  string `json:"body,omitempty"`
+		Name                  string `json:"name,omitempty"`
+		DependsOn             string `json:"depends_on,omitempty"`
+		OmitResponseOnSuccess bool   `json:"omit_response_on_success,omitempty"`
+	}
+	return json.Marshal(wire{
+		Method:                op.Method,
+		RelativeURL:           op.RelativeURL,
+		Body:                  op.Body,
+		Name:                  op.Name,
+		DependsOn:             op.DependsOn,
+		OmitResponseOnSuccess: op.OmitResponseOnSuccess,
+	})
+}
+
+// BatchResultHeader is one HTTP header on a BatchResult.
+type BatchResultHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// BatchResult is the raw per-op result returned from a Graph API batch
+// call, in the same order as the ops that were sent.
+type BatchResult struct {
+	Code    int                 `json:"code"`
+	Headers []BatchResultHeader `json:"headers"`
+	Body    string              `json:"body"`
+}
+
+// Decode unmarshals the result's body into v, e.g. a Profile for a
+// ProfileByID op queued through a BatchCollector.
+func (br BatchResult) Decode(v interface{}) error {
+	return json.Unmarshal([]byte(br.Body), v)
+}
+
+// BatchCollector queues BatchOps so several Graph API calls can be flushed
+// in a single request instead of one round-trip each. Pass one to
+// ProfileByID, GreetingSetting or CallToActionsSetting to have them queue an
+// op instead of executing immediately, or call QueueSend,
+// QueueSendGeneralMessage, QueueSendWithReplies or QueueAttachment to queue
+// a message send, then call Messenger.Batch with the collector's Ops, or
+// Messenger.Flush with the collector itself.
+type BatchCollector struct {
+	ops []BatchOp
+}
+
+// NewBatchCollector returns an empty BatchCollector.
+func NewBatchCollector() *BatchCollector {
+	return &BatchCollector{}
+}
+
+// Add queues op, naming it if it doesn't already have a Name, and returns
+// the name so later ops can reference it via DependsOn.
+func (b *BatchCollector) Add(op BatchOp) string {
+	if op.Name == "" {
+		op.Name = fmt.Sprintf("op%d", len(b.ops))
+	}
+	b.ops = append(b.ops, op)
+	return op.Name
+}
+
+// Ops returns the ops queued so far, in the order they were added.
+func (b *BatchCollector) Ops() []BatchOp {
+	return b.ops
+}
+
+// batchCollectorFrom extracts the optional trailing *BatchCollector used by
+// the variadic "batch ...*BatchCollector" parameter on ProfileByID,
+// GreetingSetting and CallToActionsSetting.
+func batchCollectorFrom(batch []*BatchCollector) *BatchCollector {
+	if len(batch) == 0 {
+		return nil
+	}
+	return batch[0]
+}
+
+// sendMessageBody mirrors the "message" object of the Facebook Send API.
+// It's only used to build a BatchOp's Body when a send call is queued
+// through a BatchCollector instead of sent immediately via Response.
+type sendMessageBody struct {
+	Text         string          `json:"text,omitempty"`
+	QuickReplies []QuickReply    `json:"quick_replies,omitempty"`
+	Attachment   *sendAttachment `json:"attachment,omitempty"`
+}
+
+// sendAttachment mirrors the Send API's "message.attachment" object, used
+// for both media attachments and the generic template.
+type sendAttachment struct {
+	Type    AttachmentType        `json:"type"`
+	Payload sendAttachmentPayload `json:"payload"`
+}
+
+// sendAttachmentPayload mirrors the Send API's attachment payload. Only the
+// fields relevant to the attachment type being sent are populated.
+type sendAttachmentPayload struct {
+	URL          string                      `json:"url,omitempty"`
+	TemplateType string                      `json:"template_type,omitempty"`
+	Elements     *[]StructuredMessageElement `json:"elements,omitempty"`
+}
+
+// queueSend marshals a Send API body for (to, messagingType, tags, message)
+// and adds it to b as a "me/messages" BatchOp.
+func queueSend(b *BatchCollector, to Recipient, messagingType MessagingType, tags []string, message sendMessageBody) error {
+	body := struct {
+		Recipient     Recipient       `json:"recipient"`
+		MessagingType MessagingType   `json:"messaging_type,omitempty"`
+		Tag           string          `json:"tag,omitempty"`
+		Message       sendMessageBody `json:"message"`
+	}{
+		Recipient:     to,
+		MessagingType: messagingType,
+		Message:       message,
+	}
+	if len(tags) > 0 {
+		body.Tag = tags[0]
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	b.Add(BatchOp{
+		Method:      "POST",
+		RelativeURL: "me/messages",
+		Body:        string(data),
+	})
+	return nil
+}
+
+// Batch sends up to 50 ops to the Graph API batch endpoint in a single POST
+// and returns their results in the same order the ops were given.
+func (m *Messenger) Batch(ctx context.Context, ops []BatchOp) ([]BatchResult, error) {
+	if len(ops) == 0 {
+		return nil, nil
+	}
+	if len(ops) > 50 {
+		return nil, fmt.Errorf("messenger: batch supports at most 50 ops, got %d", len(ops))
+	}
+
+	payload, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("access_token", m.token)
+	form.Set("batch", string(payload))
+
+	req, err := http.NewRequest("POST", GraphURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []BatchResult
+	if err := json.Unmarshal(content, &results); err != nil {
+		qr := QueryResponse{}
+		if jErr := json.Unmarshal(content, &qr); jErr == nil && qr.Error != nil {
+			return nil, fmt.Errorf("Facebook error : %s", qr.Error.Message)
+		}
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Flush sends every op queued on b via Batch.
+func (m *Messenger) Flush(ctx context.Context, b *BatchCollector) ([]BatchResult, error) {
+	return m.Batch(ctx, b.Ops())
+}
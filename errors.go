@@ -0,0 +1,44 @@
+package messenger
+
+import "fmt"
+
+// FacebookError is the structured error Facebook's Graph API returns on
+// failure, e.g. `{"error": {"message": "...", "type": "OAuthException",
+// "code": 190, "error_subcode": 463, "fbtrace_id": "..."}}`.
+type FacebookError struct {
+	Message      string `json:"message"`
+	Type         string `json:"type"`
+	Code         int    `json:"code"`
+	ErrorSubcode int    `json:"error_subcode"`
+	FBTraceID    string `json:"fbtrace_id"`
+}
+
+// Error implements the error interface.
+func (e *FacebookError) Error() string {
+	if e.ErrorSubcode != 0 {
+		return fmt.Sprintf("facebook error: %s (type=%s code=%d subcode=%d fbtrace_id=%s)",
+			e.Message, e.Type, e.Code, e.ErrorSubcode, e.FBTraceID)
+	}
+	return fmt.Sprintf("facebook error: %s (type=%s code=%d fbtrace_id=%s)",
+		e.Message, e.Type, e.Code, e.FBTraceID)
+}
+
+// transientFacebookErrorCodes are the Facebook error codes known to be
+// transient (typically rate limiting or momentary platform hiccups) and
+// therefore worth retrying. See
+// https://developers.facebook.com/docs/graph-api/guides/error-handling.
+var transientFacebookErrorCodes = map[int]bool{
+	1:   true, // API Unknown
+	2:   true, // API Service
+	4:   true, // API Too Many Calls
+	17:  true, // API User Too Many Calls
+	341: true, // Application limit reached
+	613: true, // Custom rate limit hit (thread_settings, send API, ...)
+}
+
+// IsTransient reports whether e is the kind of Facebook error that's worth
+// retrying with backoff, as opposed to a permanent failure like bad input
+// or an expired token.
+func (e *FacebookError) IsTransient() bool {
+	return transientFacebookErrorCodes[e.Code]
+}
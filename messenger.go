@@ -5,11 +5,14 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,6 +26,21 @@ const (
 	SendSettingsURL = "https://graph.facebook.com/v2.6/me/thread_settings"
 )
 
+// SignatureAlgorithm selects which X-Hub-Signature header checkIntegrity
+// honours when verifying an inbound webhook payload.
+type SignatureAlgorithm string
+
+const (
+	// SignatureAlgorithmAuto prefers the SHA-256 signature
+	// (X-Hub-Signature-256) when present and falls back to the legacy
+	// SHA-1 signature (X-Hub-Signature) otherwise. This is the default.
+	SignatureAlgorithmAuto SignatureAlgorithm = "auto"
+	// SignatureAlgorithmSHA1 requires the legacy X-Hub-Signature header.
+	SignatureAlgorithmSHA1 SignatureAlgorithm = "sha1"
+	// SignatureAlgorithmSHA256 requires the X-Hub-Signature-256 header.
+	SignatureAlgorithmSHA256 SignatureAlgorithm = "sha256"
+)
+
 // Options are the settings used when creating a Messenger client.
 type Options struct {
 	// Verify sets whether or not to be in the "verify" mode. Used for
@@ -38,6 +56,23 @@ type Options struct {
 	Token string
 	// Client is to allow use of custom clients like default or Google App Engine urlfetcher
 	Client *http.Client
+	// SignatureAlgorithm pins checkIntegrity to a single X-Hub-Signature
+	// header. Defaults to SignatureAlgorithmAuto, which prefers SHA-256
+	// and falls back to SHA-1 for legacy setups.
+	SignatureAlgorithm SignatureAlgorithm
+	// RetryPolicy, if set, wraps Client's transport so outbound Graph API
+	// calls are retried with backoff on transient errors (HTTP 429/5xx or
+	// the documented transient Facebook error codes).
+	RetryPolicy *RetryPolicy
+	// Queue, if set, makes Handle enqueue webhook events instead of
+	// dispatching them synchronously; call Messenger.Start to drain it.
+	// Leave nil and don't call Start to keep the synchronous behaviour;
+	// Start installs an in-memory Queue when none is set.
+	Queue Queue
+	// SeenSet dedupes webhook events drained from Queue, so a Facebook
+	// redelivery doesn't fan out to handlers twice. Only used by Start's
+	// workers; defaults to an in-memory set.
+	SeenSet SeenSet
 }
 
 // Messenger is the client which manages communication with the Messenger Platform API.
@@ -48,6 +83,22 @@ type Messenger struct {
 	verify      bool
 	appSecret   string
 	verifyToken string
+	sigAlgo     SignatureAlgorithm
+
+	messageHandlers        []func(context.Context, Message, *Response)
+	deliveryHandlers       []func(context.Context, Delivery, *Response)
+	readHandlers           []func(context.Context, Read, *Response)
+	postBackHandlers       []func(context.Context, PostBack, *Response)
+	optInHandlers          []func(context.Context, OptIn, *Response)
+	referralHandlers       []func(context.Context, Referral, *Response)
+	accountLinkingHandlers []func(context.Context, AccountLinking, *Response)
+
+	// queueMu guards queue and seen: Start lazily installs a default for
+	// either one if Options didn't set it, which would otherwise race
+	// with Handle reading queue concurrently.
+	queueMu sync.RWMutex
+	queue   Queue
+	seen    SeenSet
 }
 
 // New creates a new Messenger. You pass in Options in order to affect settings.
@@ -56,12 +107,29 @@ func New(mo Options) *Messenger {
 		mo.Client = http.DefaultClient
 	}
 
+	if mo.SignatureAlgorithm == "" {
+		mo.SignatureAlgorithm = SignatureAlgorithmAuto
+	}
+
+	if mo.RetryPolicy != nil {
+		base := mo.Client.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		client := *mo.Client
+		client.Transport = &retryTransport{base: base, policy: *mo.RetryPolicy}
+		mo.Client = &client
+	}
+
 	m := &Messenger{
 		client:      mo.Client,
 		token:       mo.Token,
 		verify:      mo.Verify,
 		appSecret:   mo.AppSecret,
 		verifyToken: mo.VerifyToken,
+		sigAlgo:     mo.SignatureAlgorithm,
+		queue:       mo.Queue,
+		seen:        mo.SeenSet,
 	}
 
 	return m
@@ -73,6 +141,10 @@ type MuxOptions struct {
 	Mux *http.ServeMux
 	// WebhookURL is where the Messenger client should listen for webhook events. Leaving the string blank implies a path of "/".
 	WebhookURL string
+	// AccountLinkingURL, if set, registers HandleAccountLinkingRedirect at
+	// this path to verify the signed_request Facebook sends to the
+	// account-linking webview.
+	AccountLinkingURL string
 }
 
 // SetupHandler for http handler options
@@ -88,6 +160,10 @@ func (m *Messenger) SetupHandler(mo *MuxOptions) {
 	m.mux = mo.Mux
 
 	m.mux.HandleFunc(mo.WebhookURL, m.Handle)
+
+	if mo.AccountLinkingURL != "" {
+		m.mux.HandleFunc(mo.AccountLinkingURL, m.HandleAccountLinkingRedirect)
+	}
 }
 
 // Handler returns the Messenger in HTTP client form.
@@ -98,11 +174,22 @@ func (m *Messenger) Handler() http.Handler {
 	return m.mux
 }
 
-// ProfileByID retrieves the Facebook user associated with that ID
-func (m *Messenger) ProfileByID(id int64) (Profile, error) {
+// ProfileByID retrieves the Facebook user associated with that ID. Passing a
+// *BatchCollector queues the lookup for a later Messenger.Batch call instead
+// of issuing the request immediately; the returned Profile is then zero and
+// should be ignored in favor of decoding the matching BatchResult.
+func (m *Messenger) ProfileByID(id int64, batch ...*BatchCollector) (Profile, error) {
 	p := Profile{}
 	url := fmt.Sprintf("%v%v", ProfileURL, id)
 
+	if b := batchCollectorFrom(batch); b != nil {
+		b.Add(BatchOp{
+			Method:      "GET",
+			RelativeURL: fmt.Sprintf("%v?fields=%v", id, ProfileFields),
+		})
+		return p, nil
+	}
+
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return p, err
@@ -130,15 +217,23 @@ func (m *Messenger) ProfileByID(id int64) (Profile, error) {
 		qr := QueryResponse{}
 		err = json.Unmarshal(content, &qr)
 		if qr.Error != nil {
-			err = fmt.Errorf("Facebook error : %s", qr.Error.Message)
+			err = &FacebookError{
+				Message:      qr.Error.Message,
+				Type:         qr.Error.Type,
+				Code:         qr.Error.Code,
+				ErrorSubcode: qr.Error.ErrorSubcode,
+				FBTraceID:    qr.Error.FBTraceID,
+			}
 		}
 	}
 
 	return p, err
 }
 
-// GreetingSetting sends settings for greeting
-func (m *Messenger) GreetingSetting(text string) error {
+// GreetingSetting sends settings for greeting. Passing a *BatchCollector
+// queues the call for a later Messenger.Batch call instead of sending it
+// immediately.
+func (m *Messenger) GreetingSetting(text string, batch ...*BatchCollector) error {
 	d := GreetingSetting{
 		SettingType: "greeting",
 		Greeting: GreetingInfo{
@@ -151,6 +246,15 @@ func (m *Messenger) GreetingSetting(text string) error {
 		return err
 	}
 
+	if b := batchCollectorFrom(batch); b != nil {
+		b.Add(BatchOp{
+			Method:      "POST",
+			RelativeURL: "me/thread_settings",
+			Body:        string(data),
+		})
+		return nil
+	}
+
 	req, err := http.NewRequest("POST", SendSettingsURL, bytes.NewBuffer(data))
 	if err != nil {
 		return err
@@ -168,8 +272,10 @@ func (m *Messenger) GreetingSetting(text string) error {
 	return checkFacebookError(resp.Body)
 }
 
-// CallToActionsSetting sends settings for Get Started or Persist Menu
-func (m *Messenger) CallToActionsSetting(state string, actions []CallToActionsItem) error {
+// CallToActionsSetting sends settings for Get Started or Persist Menu.
+// Passing a *BatchCollector queues the call for a later Messenger.Batch
+// call instead of sending it immediately.
+func (m *Messenger) CallToActionsSetting(state string, actions []CallToActionsItem, batch ...*BatchCollector) error {
 	d := CallToActionsSetting{
 		SettingType:   "call_to_actions",
 		ThreadState:   state,
@@ -181,6 +287,15 @@ func (m *Messenger) CallToActionsSetting(state string, actions []CallToActionsIt
 		return err
 	}
 
+	if b := batchCollectorFrom(batch); b != nil {
+		b.Add(BatchOp{
+			Method:      "POST",
+			RelativeURL: "me/thread_settings",
+			Body:        string(data),
+		})
+		return nil
+	}
+
 	req, err := http.NewRequest("POST", SendSettingsURL, bytes.NewBuffer(data))
 	if err != nil {
 		return err
@@ -208,12 +323,12 @@ func (m *Messenger) Handle(w http.ResponseWriter, r *http.Request) {
 
 	var rec Receive
 
-	ctx := r.Context()
-
 	// consume a *copy* of the request body
 	body, _ := ioutil.ReadAll(r.Body)
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
 
+	ctx := context.WithValue(r.Context(), rawBodyContextKey, body)
+
 	err := json.Unmarshal(body, &rec)
 	if err != nil {
 		fmt.Println("could not decode response:", err)
@@ -235,45 +350,82 @@ func (m *Messenger) Handle(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	m.dispatch(ctx, rec)
+	if q := m.currentQueue(); q != nil {
+		if err := q.Enqueue(ctx, rec); err != nil {
+			fmt.Println("could not enqueue webhook event:", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	} else {
+		m.dispatch(ctx, rec)
+	}
 
 	fmt.Fprintln(w, `{status: 'ok'}`)
 }
 
-// checkIntegrity checks the integrity of the requests received
+// checkIntegrity checks the integrity of the requests received. It prefers
+// the SHA-256 signature (X-Hub-Signature-256) when present, falling back to
+// the legacy SHA-1 signature (X-Hub-Signature) for older setups. Set
+// Options.SignatureAlgorithm to pin to a single header instead.
 func (m *Messenger) checkIntegrity(r *http.Request) error {
 	if m.appSecret == "" {
 		return fmt.Errorf("missing app secret")
 	}
 
-	sigHeader := "X-Hub-Signature"
-	sig := strings.SplitN(r.Header.Get(sigHeader), "=", 2)
-	if len(sig) == 1 {
-		if sig[0] == "" {
-			return fmt.Errorf("missing %s header", sigHeader)
+	const (
+		sha1Header   = "X-Hub-Signature"
+		sha256Header = "X-Hub-Signature-256"
+	)
+
+	parseSig := func(header, raw string) (enc, hash string, err error) {
+		sig := strings.SplitN(raw, "=", 2)
+		if len(sig) == 1 {
+			if sig[0] == "" {
+				return "", "", fmt.Errorf("missing %s header", header)
+			}
+			return "", "", fmt.Errorf("malformed %s header: %v", header, strings.Join(sig, "="))
 		}
-		return fmt.Errorf("malformed %s header: %v", sigHeader, strings.Join(sig, "="))
+		return strings.ToLower(sig[0]), strings.ToLower(sig[1]), nil
 	}
 
-	checkSHA1 := func(body []byte, hash string) error {
-		mac := hmac.New(sha1.New, []byte(m.appSecret))
-		if mac.Write(body); fmt.Sprintf("%x", mac.Sum(nil)) != hash {
-			return fmt.Errorf("invalid signature: %s", hash)
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+
+	check := func(newHash func() hash.Hash, header, wantHash string) error {
+		mac := hmac.New(newHash, []byte(m.appSecret))
+		mac.Write(body)
+		sum := fmt.Sprintf("%x", mac.Sum(nil))
+		if !hmac.Equal([]byte(sum), []byte(wantHash)) {
+			return fmt.Errorf("invalid %s signature: %s", header, wantHash)
 		}
 		return nil
 	}
 
-	body, _ := ioutil.ReadAll(r.Body)
-	r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	algo := m.sigAlgo
+	if algo == "" {
+		algo = SignatureAlgorithmAuto
+	}
 
-	sigEnc := strings.ToLower(sig[0])
-	sigHash := strings.ToLower(sig[1])
-	switch sigEnc {
-	case "sha1":
-		return checkSHA1(body, sigHash)
-	default:
-		return fmt.Errorf("unknown %s header encoding, expected sha1: %s", sigHeader, sig[0])
+	sha256Raw := r.Header.Get(sha256Header)
+	if algo == SignatureAlgorithmSHA256 || (algo == SignatureAlgorithmAuto && sha256Raw != "") {
+		enc, wantHash, err := parseSig(sha256Header, sha256Raw)
+		if err != nil {
+			return err
+		}
+		if enc != "sha256" {
+			return fmt.Errorf("unknown %s header encoding, expected sha256: %s", sha256Header, enc)
+		}
+		return check(sha256.New, sha256Header, wantHash)
+	}
+
+	enc, wantHash, err := parseSig(sha1Header, r.Header.Get(sha1Header))
+	if err != nil {
+		return err
 	}
+	if enc != "sha1" {
+		return fmt.Errorf("unknown %s header encoding, expected sha1: %s", sha1Header, enc)
+	}
+	return check(sha1.New, sha1Header, wantHash)
 }
 
 // dispatch triggers all of the relevant handlers when a webhook event is received.
@@ -294,7 +446,7 @@ func (m *Messenger) dispatch(ctx context.Context, r Receive) {
 
 			switch a {
 			case TextAction:
-				for _, f := range Handlers.messageHandlers {
+				for _, f := range m.resolveMessageHandlers() {
 					message := *info.Message
 					message.Sender = info.Sender
 					message.Recipient = info.Recipient
@@ -302,15 +454,15 @@ func (m *Messenger) dispatch(ctx context.Context, r Receive) {
 					f(ctx, message, resp)
 				}
 			case DeliveryAction:
-				for _, f := range Handlers.deliveryHandlers {
+				for _, f := range m.resolveDeliveryHandlers() {
 					f(ctx, *info.Delivery, resp)
 				}
 			case ReadAction:
-				for _, f := range Handlers.readHandlers {
+				for _, f := range m.resolveReadHandlers() {
 					f(ctx, *info.Read, resp)
 				}
 			case PostBackAction:
-				for _, f := range Handlers.postBackHandlers {
+				for _, f := range m.resolvePostBackHandlers() {
 					message := *info.PostBack
 					message.Sender = info.Sender
 					message.Recipient = info.Recipient
@@ -318,7 +470,7 @@ func (m *Messenger) dispatch(ctx context.Context, r Receive) {
 					f(ctx, message, resp)
 				}
 			case OptInAction:
-				for _, f := range Handlers.optInHandlers {
+				for _, f := range m.resolveOptInHandlers() {
 					message := *info.OptIn
 					message.Sender = info.Sender
 					message.Recipient = info.Recipient
@@ -326,7 +478,7 @@ func (m *Messenger) dispatch(ctx context.Context, r Receive) {
 					f(ctx, message, resp)
 				}
 			case ReferralAction:
-				for _, f := range Handlers.referralHandlers {
+				for _, f := range m.resolveReferralHandlers() {
 					message := *info.ReferralMessage
 					message.Sender = info.Sender
 					message.Recipient = info.Recipient
@@ -334,7 +486,7 @@ func (m *Messenger) dispatch(ctx context.Context, r Receive) {
 					f(ctx, message, resp)
 				}
 			case AccountLinkingAction:
-				for _, f := range Handlers.accountLinkingHandlers {
+				for _, f := range m.resolveAccountLinkingHandlers() {
 					message := *info.AccountLinking
 					message.Sender = info.Sender
 					message.Recipient = info.Recipient
@@ -346,6 +498,157 @@ func (m *Messenger) dispatch(ctx context.Context, r Receive) {
 	}
 }
 
+// resolveMessageHandlers returns m's own message handlers, falling back to
+// the deprecated package-level registry so that handlers registered through
+// the legacy HandleMessage function keep firing.
+func (m *Messenger) resolveMessageHandlers() []func(context.Context, Message, *Response) {
+	if len(m.messageHandlers) > 0 {
+		return m.messageHandlers
+	}
+	return defaultMessenger.messageHandlers
+}
+
+func (m *Messenger) resolveDeliveryHandlers() []func(context.Context, Delivery, *Response) {
+	if len(m.deliveryHandlers) > 0 {
+		return m.deliveryHandlers
+	}
+	return defaultMessenger.deliveryHandlers
+}
+
+func (m *Messenger) resolveReadHandlers() []func(context.Context, Read, *Response) {
+	if len(m.readHandlers) > 0 {
+		return m.readHandlers
+	}
+	return defaultMessenger.readHandlers
+}
+
+func (m *Messenger) resolvePostBackHandlers() []func(context.Context, PostBack, *Response) {
+	if len(m.postBackHandlers) > 0 {
+		return m.postBackHandlers
+	}
+	return defaultMessenger.postBackHandlers
+}
+
+func (m *Messenger) resolveOptInHandlers() []func(context.Context, OptIn, *Response) {
+	if len(m.optInHandlers) > 0 {
+		return m.optInHandlers
+	}
+	return defaultMessenger.optInHandlers
+}
+
+func (m *Messenger) resolveReferralHandlers() []func(context.Context, Referral, *Response) {
+	if len(m.referralHandlers) > 0 {
+		return m.referralHandlers
+	}
+	return defaultMessenger.referralHandlers
+}
+
+func (m *Messenger) resolveAccountLinkingHandlers() []func(context.Context, AccountLinking, *Response) {
+	if len(m.accountLinkingHandlers) > 0 {
+		return m.accountLinkingHandlers
+	}
+	return defaultMessenger.accountLinkingHandlers
+}
+
+// HandleMessage registers a handler to be run whenever a text message is
+// received by this Messenger instance.
+func (m *Messenger) HandleMessage(f func(ctx context.Context, message Message, r *Response)) {
+	m.messageHandlers = append(m.messageHandlers, f)
+}
+
+// HandleDelivery registers a handler to be run whenever a delivery
+// confirmation is received by this Messenger instance.
+func (m *Messenger) HandleDelivery(f func(ctx context.Context, d Delivery, r *Response)) {
+	m.deliveryHandlers = append(m.deliveryHandlers, f)
+}
+
+// HandleRead registers a handler to be run whenever a read confirmation is
+// received by this Messenger instance.
+func (m *Messenger) HandleRead(f func(ctx context.Context, read Read, r *Response)) {
+	m.readHandlers = append(m.readHandlers, f)
+}
+
+// HandlePostBack registers a handler to be run whenever a postback is
+// received by this Messenger instance.
+func (m *Messenger) HandlePostBack(f func(ctx context.Context, p PostBack, r *Response)) {
+	m.postBackHandlers = append(m.postBackHandlers, f)
+}
+
+// HandleOptIn registers a handler to be run whenever an opt-in event is
+// received by this Messenger instance.
+func (m *Messenger) HandleOptIn(f func(ctx context.Context, o OptIn, r *Response)) {
+	m.optInHandlers = append(m.optInHandlers, f)
+}
+
+// HandleReferral registers a handler to be run whenever a referral event is
+// received by this Messenger instance.
+func (m *Messenger) HandleReferral(f func(ctx context.Context, ref Referral, r *Response)) {
+	m.referralHandlers = append(m.referralHandlers, f)
+}
+
+// HandleAccountLinking registers a handler to be run whenever an account
+// linking event is received by this Messenger instance.
+func (m *Messenger) HandleAccountLinking(f func(ctx context.Context, al AccountLinking, r *Response)) {
+	m.accountLinkingHandlers = append(m.accountLinkingHandlers, f)
+}
+
+// defaultMessenger backs the deprecated package-level HandleX functions so
+// that code which never constructs its own Messenger keeps working. New
+// code should call the HandleX methods on a *Messenger returned by New
+// instead, since the package-level registry can't distinguish between
+// multiple Messenger clients running in the same process.
+var defaultMessenger = &Messenger{}
+
+// HandleMessage registers a handler on the default Messenger instance.
+//
+// Deprecated: call the HandleMessage method on a *Messenger returned by New.
+func HandleMessage(f func(ctx context.Context, message Message, r *Response)) {
+	defaultMessenger.HandleMessage(f)
+}
+
+// HandleDelivery registers a handler on the default Messenger instance.
+//
+// Deprecated: call the HandleDelivery method on a *Messenger returned by New.
+func HandleDelivery(f func(ctx context.Context, d Delivery, r *Response)) {
+	defaultMessenger.HandleDelivery(f)
+}
+
+// HandleRead registers a handler on the default Messenger instance.
+//
+// Deprecated: call the HandleRead method on a *Messenger returned by New.
+func HandleRead(f func(ctx context.Context, read Read, r *Response)) {
+	defaultMessenger.HandleRead(f)
+}
+
+// HandlePostBack registers a handler on the default Messenger instance.
+//
+// Deprecated: call the HandlePostBack method on a *Messenger returned by New.
+func HandlePostBack(f func(ctx context.Context, p PostBack, r *Response)) {
+	defaultMessenger.HandlePostBack(f)
+}
+
+// HandleOptIn registers a handler on the default Messenger instance.
+//
+// Deprecated: call the HandleOptIn method on a *Messenger returned by New.
+func HandleOptIn(f func(ctx context.Context, o OptIn, r *Response)) {
+	defaultMessenger.HandleOptIn(f)
+}
+
+// HandleReferral registers a handler on the default Messenger instance.
+//
+// Deprecated: call the HandleReferral method on a *Messenger returned by New.
+func HandleReferral(f func(ctx context.Context, ref Referral, r *Response)) {
+	defaultMessenger.HandleReferral(f)
+}
+
+// HandleAccountLinking registers a handler on the default Messenger instance.
+//
+// Deprecated: call the HandleAccountLinking method on a *Messenger returned
+// by New.
+func HandleAccountLinking(f func(ctx context.Context, al AccountLinking, r *Response)) {
+	defaultMessenger.HandleAccountLinking(f)
+}
+
 // Response returns new Response object
 func (m *Messenger) Response(to int64) *Response {
 	return &Response{
@@ -354,12 +657,17 @@ func (m *Messenger) Response(to int64) *Response {
 	}
 }
 
-// Send will send a textual message to a user. This user must have previously initiated a conversation with the bot.
+// Send will send a textual message to a user. This user must have
+// previously initiated a conversation with the bot. To queue the call for
+// a later Messenger.Batch instead of sending it immediately, use
+// QueueSend.
 func (m *Messenger) Send(to Recipient, message string, messagingType MessagingType, tags ...string) error {
 	return m.SendWithReplies(to, message, nil, messagingType, tags...)
 }
 
-// SendGeneralMessage will send the GenericTemplate message
+// SendGeneralMessage will send the GenericTemplate message. To queue the
+// call for a later Messenger.Batch instead of sending it immediately, use
+// QueueSendGeneralMessage.
 func (m *Messenger) SendGeneralMessage(to Recipient, elements *[]StructuredMessageElement, messagingType MessagingType, tags ...string) error {
 	r := &Response{
 		token: m.token,
@@ -368,7 +676,10 @@ func (m *Messenger) SendGeneralMessage(to Recipient, elements *[]StructuredMessa
 	return r.GenericTemplate(elements, messagingType, tags...)
 }
 
-// SendWithReplies sends a textual message to a user, but gives them the option of numerous quick response options.
+// SendWithReplies sends a textual message to a user, but gives them the
+// option of numerous quick response options. To queue the call for a later
+// Messenger.Batch instead of sending it immediately, use
+// QueueSendWithReplies.
 func (m *Messenger) SendWithReplies(to Recipient, message string, replies []QuickReply, messagingType MessagingType, tags ...string) error {
 	response := &Response{
 		token: m.token,
@@ -378,7 +689,9 @@ func (m *Messenger) SendWithReplies(to Recipient, message string, replies []Quic
 	return response.TextWithReplies(message, replies, messagingType, tags...)
 }
 
-// Attachment sends an image, sound, video or a regular file to a given recipient.
+// Attachment sends an image, sound, video or a regular file to a given
+// recipient. To queue the call for a later Messenger.Batch instead of
+// sending it immediately, use QueueAttachment.
 func (m *Messenger) Attachment(to Recipient, dataType AttachmentType, url string, messagingType MessagingType, tags ...string) error {
 	response := &Response{
 		token: m.token,
@@ -388,6 +701,49 @@ func (m *Messenger) Attachment(to Recipient, dataType AttachmentType, url string
 	return response.Attachment(dataType, url, messagingType, tags...)
 }
 
+// QueueSend queues a Send call as a "me/messages" op on b instead of
+// sending it immediately; flush b with Messenger.Batch or Messenger.Flush.
+func (m *Messenger) QueueSend(b *BatchCollector, to Recipient, message string, messagingType MessagingType, tags ...string) error {
+	return m.QueueSendWithReplies(b, to, message, nil, messagingType, tags...)
+}
+
+// QueueSendGeneralMessage queues a SendGeneralMessage call as a
+// "me/messages" op on b instead of sending it immediately; flush b with
+// Messenger.Batch or Messenger.Flush.
+func (m *Messenger) QueueSendGeneralMessage(b *BatchCollector, to Recipient, elements *[]StructuredMessageElement, messagingType MessagingType, tags ...string) error {
+	return queueSend(b, to, messagingType, tags, sendMessageBody{
+		Attachment: &sendAttachment{
+			Type: "template",
+			Payload: sendAttachmentPayload{
+				TemplateType: "generic",
+				Elements:     elements,
+			},
+		},
+	})
+}
+
+// QueueSendWithReplies queues a SendWithReplies call as a "me/messages" op
+// on b instead of sending it immediately; flush b with Messenger.Batch or
+// Messenger.Flush.
+func (m *Messenger) QueueSendWithReplies(b *BatchCollector, to Recipient, message string, replies []QuickReply, messagingType MessagingType, tags ...string) error {
+	return queueSend(b, to, messagingType, tags, sendMessageBody{
+		Text:         message,
+		QuickReplies: replies,
+	})
+}
+
+// QueueAttachment queues an Attachment call as a "me/messages" op on b
+// instead of sending it immediately; flush b with Messenger.Batch or
+// Messenger.Flush.
+func (m *Messenger) QueueAttachment(b *BatchCollector, to Recipient, dataType AttachmentType, url string, messagingType MessagingType, tags ...string) error {
+	return queueSend(b, to, messagingType, tags, sendMessageBody{
+		Attachment: &sendAttachment{
+			Type:    dataType,
+			Payload: sendAttachmentPayload{URL: url},
+		},
+	})
+}
+
 // classify determines what type of message a webhook event is.
 func (m *Messenger) classify(info MessageInfo, e Entry) Action {
 	if info.Message != nil {
@@ -416,3 +772,19 @@ func (m *Messenger) verifyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	http.Error(w, "Incorrect verify token", http.StatusForbidden)
 }
+
+// contextKey is an unexported type used for context.Context values set by
+// this package, so they can't collide with keys from other packages.
+type contextKey int
+
+// rawBodyContextKey is the context.Context key under which Handle stashes
+// the raw webhook request body, so handlers don't have to re-read it.
+const rawBodyContextKey contextKey = 0
+
+// RawBodyFromContext returns the raw webhook request body that Handle
+// stashed on the context, if any. Only handlers that Handle dispatches
+// synchronously get it; events drained from a Queue by Start carry no body.
+func RawBodyFromContext(ctx context.Context) ([]byte, bool) {
+	body, ok := ctx.Value(rawBodyContextKey).([]byte)
+	return body, ok
+}
@@ -0,0 +1,129 @@
+package messenger
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func newIntegrityRequest(t *testing.T, body []byte) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("POST", "https://example.com/webhook", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	return req
+}
+
+func sha1Signature(secret string, body []byte) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(body)
+	return fmt.Sprintf("sha1=%x", mac.Sum(nil))
+}
+
+func sha256Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return fmt.Sprintf("sha256=%x", mac.Sum(nil))
+}
+
+func TestCheckIntegrityAutoPrefersValidSHA256(t *testing.T) {
+	body := []byte(`{"object":"page"}`)
+	m := &Messenger{appSecret: "app-secret", sigAlgo: SignatureAlgorithmAuto}
+
+	req := newIntegrityRequest(t, body)
+	req.Header.Set("X-Hub-Signature-256", sha256Signature("app-secret", body))
+	req.Header.Set("X-Hub-Signature", "sha1=deadbeef") // stale/forged, must be ignored
+
+	if err := m.checkIntegrity(req); err != nil {
+		t.Fatalf("expected valid SHA-256 signature to pass, got: %v", err)
+	}
+}
+
+func TestCheckIntegrityAutoFallsBackToSHA1(t *testing.T) {
+	body := []byte(`{"object":"page"}`)
+	m := &Messenger{appSecret: "app-secret", sigAlgo: SignatureAlgorithmAuto}
+
+	req := newIntegrityRequest(t, body)
+	req.Header.Set("X-Hub-Signature", sha1Signature("app-secret", body))
+
+	if err := m.checkIntegrity(req); err != nil {
+		t.Fatalf("expected legacy SHA-1 signature to pass, got: %v", err)
+	}
+}
+
+func TestCheckIntegrityForgedSHA256(t *testing.T) {
+	body := []byte(`{"object":"page"}`)
+	m := &Messenger{appSecret: "app-secret", sigAlgo: SignatureAlgorithmAuto}
+
+	req := newIntegrityRequest(t, body)
+	req.Header.Set("X-Hub-Signature-256", "sha256="+fmt.Sprintf("%x", make([]byte, sha256.Size)))
+
+	if err := m.checkIntegrity(req); err == nil {
+		t.Fatal("expected forged SHA-256 signature to be rejected")
+	}
+}
+
+func TestCheckIntegrityForgedSHA1(t *testing.T) {
+	body := []byte(`{"object":"page"}`)
+	m := &Messenger{appSecret: "app-secret", sigAlgo: SignatureAlgorithmAuto}
+
+	req := newIntegrityRequest(t, body)
+	req.Header.Set("X-Hub-Signature", "sha1="+fmt.Sprintf("%x", make([]byte, sha1.Size)))
+
+	if err := m.checkIntegrity(req); err == nil {
+		t.Fatal("expected forged SHA-1 signature to be rejected")
+	}
+}
+
+func TestCheckIntegrityMissingHeader(t *testing.T) {
+	body := []byte(`{"object":"page"}`)
+	m := &Messenger{appSecret: "app-secret", sigAlgo: SignatureAlgorithmAuto}
+
+	req := newIntegrityRequest(t, body)
+
+	if err := m.checkIntegrity(req); err == nil {
+		t.Fatal("expected missing signature header to be rejected")
+	}
+}
+
+func TestCheckIntegrityPinnedSHA256RejectsSHA1Only(t *testing.T) {
+	body := []byte(`{"object":"page"}`)
+	m := &Messenger{appSecret: "app-secret", sigAlgo: SignatureAlgorithmSHA256}
+
+	req := newIntegrityRequest(t, body)
+	req.Header.Set("X-Hub-Signature", sha1Signature("app-secret", body))
+
+	if err := m.checkIntegrity(req); err == nil {
+		t.Fatal("expected pinning to sha256 to reject a request with only an X-Hub-Signature header")
+	}
+}
+
+func TestCheckIntegrityMismatchedAlgorithmHeader(t *testing.T) {
+	body := []byte(`{"object":"page"}`)
+	m := &Messenger{appSecret: "app-secret", sigAlgo: SignatureAlgorithmSHA1}
+
+	req := newIntegrityRequest(t, body)
+	// X-Hub-Signature present but labelled as the wrong encoding.
+	req.Header.Set("X-Hub-Signature", "sha256="+fmt.Sprintf("%x", make([]byte, sha256.Size)))
+
+	if err := m.checkIntegrity(req); err == nil {
+		t.Fatal("expected a sha256-encoded X-Hub-Signature to be rejected when pinned to sha1")
+	}
+}
+
+func TestCheckIntegrityMissingAppSecret(t *testing.T) {
+	body := []byte(`{"object":"page"}`)
+	m := &Messenger{sigAlgo: SignatureAlgorithmAuto}
+
+	req := newIntegrityRequest(t, body)
+	req.Header.Set("X-Hub-Signature-256", sha256Signature("app-secret", body))
+
+	if err := m.checkIntegrity(req); err == nil {
+		t.Fatal("expected missing app secret to be rejected")
+	}
+}
@@ -0,0 +1,305 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// AckFunc acknowledges successful processing of a dequeued Receive.
+type AckFunc func()
+
+// NackFunc signals that a dequeued Receive should be redelivered. It must
+// not block: a Queue implementation that can't redeliver immediately (its
+// buffer is full, or the event has already been nacked too many times)
+// should dead-letter the event instead of blocking the worker that called
+// it.
+type NackFunc func()
+
+// Queue decouples receiving a webhook payload from processing it, so a slow
+// handler doesn't stall Facebook's webhook delivery, which retries on
+// timeout and would otherwise produce duplicate deliveries. Handle
+// validates and enqueues; Messenger.Start drains the queue with a worker
+// pool and runs dispatch. Plug in a Redis, SQS or NATS-backed Queue for a
+// durable, multi-process deployment.
+type Queue interface {
+	// Enqueue adds r to the queue. It should return quickly, since Handle
+	// calls it before responding to Facebook.
+	Enqueue(ctx context.Context, r Receive) error
+	// Dequeue blocks until a Receive is available or ctx is done. ack must
+	// be called once r has been processed successfully; nack must be
+	// called to request redelivery.
+	Dequeue(ctx context.Context) (r Receive, ack AckFunc, nack NackFunc, err error)
+}
+
+// SeenSet tracks the idempotency keys of webhook events that are in-flight
+// or have completed dispatch, so a Facebook redelivery (which happens
+// whenever Handle is slow to respond, and can land as two concurrent
+// deliveries in the queue at once) doesn't fan out to handlers twice. The
+// default, installed by Start, is an in-memory map that only dedupes
+// within a single process; pass one backed by Redis or similar to dedupe
+// across a fleet.
+//
+// MarkIfUnseen and Unmark are deliberately separate rather than a single
+// irreversible mark: drain only keeps a claim once dispatch has actually
+// completed, calling Unmark to release it otherwise, so an event that
+// panics mid-dispatch stays eligible for redelivery instead of being
+// silently dropped.
+type SeenSet interface {
+	// MarkIfUnseen atomically claims key for the caller unless another
+	// delivery has already claimed it, and reports whether it did. Of
+	// any number of concurrent calls with the same key, at most one
+	// returns true.
+	MarkIfUnseen(ctx context.Context, key string) (claimed bool, err error)
+	// Unmark releases a key claimed by MarkIfUnseen whose dispatch did
+	// not complete, so a later redelivery of the same event isn't
+	// dropped.
+	Unmark(ctx context.Context, key string) error
+}
+
+// eventKey is the idempotency key for a single messaging event: the entry
+// ID, the event's own timestamp, and the sender ID. A Facebook redelivery
+// repeats this triple exactly.
+func eventKey(entryID string, info MessageInfo) string {
+	return fmt.Sprintf("%s:%d:%d", entryID, info.Timestamp, info.Sender.ID)
+}
+
+// defaultMaxRedeliveries bounds how many times memoryQueue will redeliver a
+// nacked Receive before giving up on it, so a single event that always
+// fails to dispatch (a "poison" event) can't spin a worker forever.
+const defaultMaxRedeliveries = 5
+
+// queuedReceive is what memoryQueue actually stores, tracking nack count
+// internally; Receive itself carries no redelivery bookkeeping.
+type queuedReceive struct {
+	r        Receive
+	attempts int
+}
+
+// memoryQueue is a bounded, in-memory Queue. It's the default installed by
+// Start when Messenger has no Queue configured.
+type memoryQueue struct {
+	ch              chan queuedReceive
+	maxRedeliveries int
+	onDeadLetter    func(Receive)
+}
+
+// NewMemoryQueue returns a Queue backed by a bounded in-memory channel.
+// Enqueue blocks, respecting ctx, once size Receives are buffered. A
+// Receive that's nacked defaultMaxRedeliveries times, or whose redelivery
+// finds the buffer full, is dropped and logged rather than retried
+// forever; use NewMemoryQueueWithDeadLetter to handle that case yourself.
+func NewMemoryQueue(size int) Queue {
+	return NewMemoryQueueWithDeadLetter(size, defaultMaxRedeliveries, nil)
+}
+
+// NewMemoryQueueWithDeadLetter is like NewMemoryQueue, but gives up
+// redelivering a Receive after maxRedeliveries nacks (or a redelivery that
+// finds the buffer full) and passes it to onDeadLetter instead of retrying
+// forever. A nil onDeadLetter logs and drops the Receive.
+func NewMemoryQueueWithDeadLetter(size, maxRedeliveries int, onDeadLetter func(Receive)) Queue {
+	if maxRedeliveries < 1 {
+		maxRedeliveries = 1
+	}
+	return &memoryQueue{
+		ch:              make(chan queuedReceive, size),
+		maxRedeliveries: maxRedeliveries,
+		onDeadLetter:    onDeadLetter,
+	}
+}
+
+func (q *memoryQueue) Enqueue(ctx context.Context, r Receive) error {
+	select {
+	case q.ch <- queuedReceive{r: r}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *memoryQueue) Dequeue(ctx context.Context) (Receive, AckFunc, NackFunc, error) {
+	select {
+	case qr := <-q.ch:
+		nack := func() { q.nack(qr) }
+		return qr.r, func() {}, nack, nil
+	case <-ctx.Done():
+		return Receive{}, nil, nil, ctx.Err()
+	}
+}
+
+// nack redelivers qr unless it has been nacked maxRedeliveries times
+// already or the buffer has no room, dead-lettering it instead in either
+// case. It never blocks the calling worker.
+func (q *memoryQueue) nack(qr queuedReceive) {
+	qr.attempts++
+	if qr.attempts >= q.maxRedeliveries {
+		q.deadLetter(qr.r, "exceeded max redeliveries")
+		return
+	}
+
+	select {
+	case q.ch <- qr:
+	default:
+		q.deadLetter(qr.r, "queue full on redelivery")
+	}
+}
+
+func (q *memoryQueue) deadLetter(r Receive, reason string) {
+	if q.onDeadLetter != nil {
+		q.onDeadLetter(r)
+		return
+	}
+	fmt.Println("messenger: dropping webhook event,", reason)
+}
+
+// memorySeenSet is the default, process-local SeenSet installed by Start.
+type memorySeenSet struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// NewMemorySeenSet returns a SeenSet backed by an in-memory map. It grows
+// without bound for the lifetime of the process, so it's meant for
+// moderate-volume bots; swap in a TTL-backed SeenSet for high volume.
+func NewMemorySeenSet() SeenSet {
+	return &memorySeenSet{seen: make(map[string]struct{})}
+}
+
+func (s *memorySeenSet) MarkIfUnseen(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.seen[key]; ok {
+		return false, nil
+	}
+	s.seen[key] = struct{}{}
+	return true, nil
+}
+
+func (s *memorySeenSet) Unmark(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.seen, key)
+	return nil
+}
+
+// Start begins draining m's webhook event queue with the given number of
+// worker goroutines, dispatching each Receive to the same handlers as the
+// synchronous path in Handle. Handlers run with ctx rather than the HTTP
+// request's context, so RawBodyFromContext reports no body for them. If m
+// has no Queue or
+// SeenSet configured, an in-memory default of each is installed. Start
+// blocks until ctx is done.
+func (m *Messenger) Start(ctx context.Context, workers int) error {
+	m.queueMu.Lock()
+	if m.queue == nil {
+		m.queue = NewMemoryQueue(256)
+	}
+	if m.seen == nil {
+		m.seen = NewMemorySeenSet()
+	}
+	m.queueMu.Unlock()
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			m.drain(ctx)
+		}()
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// currentQueue returns m's Queue, or nil if none is configured, safe for
+// concurrent use with Start installing the default.
+func (m *Messenger) currentQueue() Queue {
+	m.queueMu.RLock()
+	defer m.queueMu.RUnlock()
+	return m.queue
+}
+
+// drain repeatedly dequeues and dispatches Receives until ctx is done.
+func (m *Messenger) drain(ctx context.Context) {
+	for {
+		r, ack, nack, err := m.queue.Dequeue(ctx)
+		if err != nil {
+			return
+		}
+
+		claimed, keys := m.claimUnseen(ctx, r)
+
+		func() {
+			defer func() {
+				if rec := recover(); rec != nil {
+					fmt.Println("recovered panic dispatching webhook event:", rec)
+					m.releaseClaims(ctx, keys)
+					nack()
+					return
+				}
+				ack()
+			}()
+			m.dispatch(ctx, claimed)
+		}()
+	}
+}
+
+// claimUnseen claims, via m.seen, every messaging event in r that isn't
+// already claimed by another delivery, returning what's left to dispatch
+// along with the idempotency keys it claimed. The caller must release
+// those keys with releaseClaims if dispatch doesn't complete successfully:
+// claiming them atomically up front (rather than checking and marking
+// separately) is what stops two concurrent deliveries of the same
+// redelivered event from both passing the check and dispatching.
+func (m *Messenger) claimUnseen(ctx context.Context, r Receive) (Receive, []string) {
+	if m.seen == nil {
+		return r, nil
+	}
+
+	var keys []string
+	filtered := r
+	filtered.Entry = nil
+
+	for _, entry := range r.Entry {
+		var kept []MessageInfo
+		for _, info := range entry.Messaging {
+			key := eventKey(entry.ID, info)
+			claimed, err := m.seen.MarkIfUnseen(ctx, key)
+			if err != nil {
+				fmt.Println("could not claim webhook event idempotency:", err)
+				kept = append(kept, info)
+				continue
+			}
+			if claimed {
+				kept = append(kept, info)
+				keys = append(keys, key)
+			}
+		}
+		if len(kept) > 0 {
+			entry.Messaging = kept
+			filtered.Entry = append(filtered.Entry, entry)
+		}
+	}
+
+	return filtered, keys
+}
+
+// releaseClaims undoes claimUnseen for keys whose dispatch didn't complete
+// successfully, so a later redelivery of the same events isn't dropped.
+func (m *Messenger) releaseClaims(ctx context.Context, keys []string) {
+	if m.seen == nil {
+		return
+	}
+	for _, key := range keys {
+		if err := m.seen.Unmark(ctx, key); err != nil {
+			fmt.Println("could not release webhook event claim:", err)
+		}
+	}
+}
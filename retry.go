@@ -0,0 +1,226 @@
+package messenger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter throttles outbound Graph API calls. Pass one via
+// RetryPolicy.Limiter to coordinate rate limiting across multiple Messenger
+// instances, e.g. several Pages handled by the same process.
+type RateLimiter interface {
+	// Wait blocks until a call may proceed, or ctx is done.
+	Wait(ctx context.Context) error
+}
+
+// tokenBucketLimiter is the default RateLimiter: it allows a burst of up to
+// rate calls, refilling continuously at rate calls per "per" interval.
+type tokenBucketLimiter struct {
+	mu       sync.Mutex
+	tokens   float64
+	max      float64
+	rate     float64 // tokens added per second
+	lastFill time.Time
+}
+
+// NewTokenBucketLimiter returns a RateLimiter allowing a burst of up to rate
+// calls, refilling continuously at rate calls per the given interval.
+func NewTokenBucketLimiter(rate int, per time.Duration) RateLimiter {
+	return &tokenBucketLimiter{
+		tokens:   float64(rate),
+		max:      float64(rate),
+		rate:     float64(rate) / per.Seconds(),
+		lastFill: time.Now(),
+	}
+}
+
+func (l *tokenBucketLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens = math.Min(l.max, l.tokens+now.Sub(l.lastFill).Seconds()*l.rate)
+		l.lastFill = now
+
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// RetryPolicy configures how Messenger retries outbound Graph API calls
+// that fail with a transient error (HTTP 429/5xx, or Facebook error codes
+// 1, 2, 4, 17, 341 and 613, which cover the documented rate-limit cases).
+// Set it via Options.RetryPolicy; a nil policy disables retrying.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first.
+	// Values below 1 are treated as 1 (no retrying).
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry; later retries back
+	// off exponentially from it. Defaults to 500ms.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff delay, after jitter is applied.
+	MaxDelay time.Duration
+	// Jitter adds up to this fraction of randomness to each delay, e.g.
+	// 0.2 for +/-20%.
+	Jitter float64
+	// Codes additionally allowlists Facebook error codes to retry, beyond
+	// the built-in transient set.
+	Codes []int
+	// Limiter, when set, is waited on before every attempt so callers can
+	// share a rate limit across Messenger instances.
+	Limiter RateLimiter
+}
+
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	base := p.BaseDelay
+	if base <= 0 {
+		base = 500 * time.Millisecond
+	}
+
+	d := time.Duration(float64(base) * math.Pow(2, float64(attempt)))
+
+	if p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + (rand.Float64()*2-1)*p.Jitter))
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+func (p RetryPolicy) retryableCode(code int) bool {
+	if transientFacebookErrorCodes[code] {
+		return true
+	}
+	for _, c := range p.Codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTransport is an http.RoundTripper that retries requests per a
+// RetryPolicy. It's installed on Messenger.client by New when
+// Options.RetryPolicy is set.
+type retryTransport struct {
+	base   http.RoundTripper
+	policy RetryPolicy
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	maxAttempts := t.policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var bodyBytes []byte
+	if req.Body != nil {
+		bodyBytes, _ = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if t.policy.Limiter != nil {
+			if werr := t.policy.Limiter.Wait(req.Context()); werr != nil {
+				return nil, werr
+			}
+		}
+
+		if bodyBytes != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+		}
+
+		resp, err = t.base.RoundTrip(req)
+		last := attempt == maxAttempts-1
+
+		if err != nil {
+			if last {
+				return nil, err
+			}
+			time.Sleep(t.policy.delay(attempt))
+			continue
+		}
+
+		if last || !t.shouldRetry(resp) {
+			return resp, nil
+		}
+
+		wait := retryAfterDelay(resp)
+		if wait == 0 {
+			wait = t.policy.delay(attempt)
+		}
+		resp.Body.Close()
+		time.Sleep(wait)
+	}
+
+	return resp, err
+}
+
+// shouldRetry inspects resp for the signals of a transient Facebook Graph
+// API failure: a 429/613/5xx status, or a body carrying one of the
+// transient Facebook error codes. Facebook delivers those error codes (4,
+// 17, 613, ...) with plain 4xx statuses as often as with 200, so the body
+// is checked on any non-5xx status too, not just 200. It restores
+// resp.Body afterwards so the caller can still read it.
+func (t *retryTransport) shouldRetry(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == 613 || resp.StatusCode >= 500 {
+		return true
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(content))
+	if err != nil {
+		return false
+	}
+
+	var qr struct {
+		Error *FacebookError `json:"error"`
+	}
+	if err := json.Unmarshal(content, &qr); err != nil || qr.Error == nil {
+		return false
+	}
+
+	return t.policy.retryableCode(qr.Error.Code)
+}
+
+// retryAfterDelay returns the delay resp's Retry-After header asks for, or
+// zero if the header is absent or unparseable.
+func retryAfterDelay(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
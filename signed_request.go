@@ -0,0 +1,137 @@
+package messenger
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SignedRequest is the verified payload Facebook delivers as a
+// "signed_request" parameter for account-linking and JS plugin flows.
+type SignedRequest struct {
+	Algorithm  string `json:"algorithm"`
+	IssuedAt   int64  `json:"issued_at"`
+	UserID     string `json:"user_id"`
+	Code       string `json:"code,omitempty"`
+	OAuthToken string `json:"oauth_token,omitempty"`
+}
+
+// ParseSignedRequest verifies and decodes a Facebook "signed_request" of the
+// form "<base64url-sig>.<base64url-payload>". The signature must be
+// HMAC-SHA256 over the raw payload segment keyed by the app secret; any
+// other algorithm is rejected.
+func (m *Messenger) ParseSignedRequest(sr string) (SignedRequest, error) {
+	var out SignedRequest
+
+	if m.appSecret == "" {
+		return out, fmt.Errorf("missing app secret")
+	}
+
+	parts := strings.SplitN(sr, ".", 2)
+	if len(parts) != 2 {
+		return out, fmt.Errorf("malformed signed_request: expected <sig>.<payload>")
+	}
+	sigPart, payloadPart := parts[0], parts[1]
+
+	sig, err := decodeBase64URL(sigPart)
+	if err != nil {
+		return out, fmt.Errorf("malformed signed_request signature: %v", err)
+	}
+
+	payload, err := decodeBase64URL(payloadPart)
+	if err != nil {
+		return out, fmt.Errorf("malformed signed_request payload: %v", err)
+	}
+
+	if err := json.Unmarshal(payload, &out); err != nil {
+		return out, err
+	}
+
+	if !strings.EqualFold(out.Algorithm, "HMAC-SHA256") {
+		return out, fmt.Errorf("unsupported signed_request algorithm: %s", out.Algorithm)
+	}
+
+	mac := hmac.New(sha256.New, []byte(m.appSecret))
+	mac.Write([]byte(payloadPart))
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return out, fmt.Errorf("invalid signed_request signature")
+	}
+
+	return out, nil
+}
+
+// SignedRequestFromRequest reads and verifies the "signed_request" form
+// value from r, as delivered to the account-linking webview and Facebook JS
+// plugin callbacks.
+func (m *Messenger) SignedRequestFromRequest(r *http.Request) (SignedRequest, error) {
+	sr := r.FormValue("signed_request")
+	if sr == "" {
+		return SignedRequest{}, fmt.Errorf("missing signed_request parameter")
+	}
+	return m.ParseSignedRequest(sr)
+}
+
+// decodeBase64URL decodes a base64url string, adding the "=" padding
+// Facebook omits.
+func decodeBase64URL(s string) ([]byte, error) {
+	if pad := len(s) % 4; pad != 0 {
+		s += strings.Repeat("=", 4-pad)
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+// signedRequestContextKey is the context.Context key under which
+// HandleAccountLinkingRedirect stashes the verified SignedRequest.
+const signedRequestContextKey contextKey = 1
+
+// SignedRequestFromContext returns the verified SignedRequest that
+// HandleAccountLinkingRedirect stashed on the context, if any.
+func SignedRequestFromContext(ctx context.Context) (SignedRequest, bool) {
+	sr, ok := ctx.Value(signedRequestContextKey).(SignedRequest)
+	return sr, ok
+}
+
+// HandleAccountLinkingRedirect is the HTTP handler for the account-linking
+// webview Facebook redirects users to. It verifies the "signed_request"
+// parameter via SignedRequestFromRequest and runs the registered
+// AccountLinking handlers so they never have to parse the raw query
+// string themselves.
+//
+// The verified SignedRequest (UserID, Code) is NOT copied onto the
+// AccountLinking value handlers receive here — unlike the AccountLinking
+// delivered through the normal webhook dispatch path, this redirect
+// carries no messaging-webhook payload to populate it from, so handlers
+// see a zero-valued AccountLinking on this path. Fetch the verified
+// payload with SignedRequestFromContext(ctx) instead.
+//
+// Register this handler via MuxOptions.AccountLinkingURL.
+func (m *Messenger) HandleAccountLinkingRedirect(w http.ResponseWriter, r *http.Request) {
+	sr, err := m.SignedRequestFromRequest(r)
+	if err != nil {
+		fmt.Println("could not verify signed_request:", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), signedRequestContextKey, sr)
+
+	userID, _ := strconv.ParseInt(sr.UserID, 10, 64)
+	resp := &Response{
+		to:     Recipient{userID},
+		token:  m.token,
+		client: m.client,
+	}
+
+	var al AccountLinking
+	for _, f := range m.resolveAccountLinkingHandlers() {
+		f(ctx, al, resp)
+	}
+
+	fmt.Fprintln(w, `{status: 'ok'}`)
+}